@@ -0,0 +1,198 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// udpBind is the default Bind implementation. It keeps separate sockets
+// for IPv4 and IPv6 so each address family can be marked/reused
+// independently, which plain net.ListenUDP on "udp" doesn't let us do.
+type udpBind struct {
+	port int
+	ipv4 *net.UDPConn
+	ipv6 *net.UDPConn
+}
+
+// NewUDPBind opens IPv4 and IPv6 UDP sockets on port. Either socket may be
+// nil if that address family isn't available on the host; Send and the
+// Receive methods then return an error for that family.
+func NewUDPBind(port int) (b *udpBind, err os.Error) {
+	b = &udpBind{port: port}
+
+	b.ipv4, err = net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		b.ipv4 = nil
+	} else if perr := enablePktInfo(b.ipv4, false); perr != nil {
+		log.Printf("bind: unable to enable IP_PKTINFO: %v", perr)
+	}
+
+	b.ipv6, err = net.ListenUDP("udp6", &net.UDPAddr{Port: port})
+	if err != nil {
+		b.ipv6 = nil
+	} else if perr := enablePktInfo(b.ipv6, true); perr != nil {
+		log.Printf("bind: unable to enable IPV6_PKTINFO: %v", perr)
+	}
+
+	if b.ipv4 == nil && b.ipv6 == nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// enablePktInfo turns on kernel delivery of the local destination address
+// alongside each received datagram (IP_PKTINFO / IPV6_RECVPKTINFO), so
+// receive() can record which local address -- and so which interface --
+// a client's packet arrived on.
+func enablePktInfo(conn *net.UDPConn, v6 bool) os.Error {
+	file, err := conn.File()
+	if err != nil {
+		return os.NewError(err.String())
+	}
+	defer file.Close()
+
+	var serr error
+	if v6 {
+		serr = syscall.SetsockoptInt(file.Fd(), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	} else {
+		serr = syscall.SetsockoptInt(file.Fd(), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	}
+	if serr != nil {
+		return os.NewError(serr.String())
+	}
+	return nil
+}
+
+func (b *udpBind) Send(buf []byte, dst *Endpoint) os.Error {
+	v6 := dst.DstIP().To4() == nil
+	conn := b.ipv4
+	if v6 {
+		conn = b.ipv6
+	}
+	if conn == nil {
+		return os.NewError("bind: no socket for destination address family")
+	}
+
+	addr := &net.UDPAddr{IP: dst.DstIP(), Port: dst.dst.Port}
+
+	// If we know which local address the client's traffic has been
+	// arriving on, ask the kernel to send the reply from that same
+	// address, so it goes back out the same interface.
+	if src := dst.SrcIP(); src != nil {
+		_, _, err := conn.WriteMsgUDP(buf, pktInfoControlMessage(src, v6), addr)
+		return err
+	}
+
+	_, err := conn.WriteToUDP(buf, addr)
+	return err
+}
+
+func (b *udpBind) ReceiveIPv4(buf []byte) (nread int, src *Endpoint, err os.Error) {
+	return b.receive(b.ipv4, buf)
+}
+
+func (b *udpBind) ReceiveIPv6(buf []byte) (nread int, src *Endpoint, err os.Error) {
+	return b.receive(b.ipv6, buf)
+}
+
+func (b *udpBind) receive(conn *net.UDPConn, buf []byte) (nread int, src *Endpoint, err os.Error) {
+	if conn == nil {
+		return 0, nil, os.NewError("bind: socket not open")
+	}
+
+	oob := make([]byte, 64)
+	nread, oobn, _, addr, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ep := NewEndpoint(addr)
+	if dst := pktInfoDstIP(oob[:oobn]); dst != nil {
+		ep.SetSrcIP(dst)
+	}
+	return nread, ep, nil
+}
+
+// pktInfoControlMessage builds an IP_PKTINFO/IPV6_PKTINFO ancillary
+// message that asks the kernel to send the outgoing packet with src as
+// its source address.
+func pktInfoControlMessage(src net.IP, v6 bool) []byte {
+	if v6 {
+		b := make([]byte, syscall.CmsgSpace(20))
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+		h.Level = syscall.IPPROTO_IPV6
+		h.Type = syscall.IPV6_PKTINFO
+		h.SetLen(syscall.CmsgLen(20))
+		copy(b[syscall.CmsgLen(0):], src.To16())
+		return b
+	}
+
+	b := make([]byte, syscall.CmsgSpace(12))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = syscall.IPPROTO_IP
+	h.Type = syscall.IP_PKTINFO
+	h.SetLen(syscall.CmsgLen(12))
+	// struct in_pktinfo { int ipi_ifindex; struct in_addr ipi_spec_dst; struct in_addr ipi_addr; }
+	// Leave ipi_ifindex zero (let the kernel route) and set ipi_spec_dst
+	// to the address we want the packet to leave from.
+	copy(b[syscall.CmsgLen(0)+4:], src.To4())
+	return b
+}
+
+// pktInfoDstIP extracts the local destination address from IP_PKTINFO /
+// IPV6_PKTINFO ancillary data, if the kernel included it.
+func pktInfoDstIP(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= 12:
+			return net.IPv4(m.Data[8], m.Data[9], m.Data[10], m.Data[11])
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO && len(m.Data) >= 16:
+			ip := make(net.IP, 16)
+			copy(ip, m.Data[0:16])
+			return ip
+		}
+	}
+	return nil
+}
+
+func (b *udpBind) Close() (err os.Error) {
+	if b.ipv4 != nil {
+		err = b.ipv4.Close()
+	}
+	if b.ipv6 != nil {
+		err = b.ipv6.Close()
+	}
+	return err
+}
+
+// SetMark applies SO_MARK to both sockets, so policy routing can steer
+// voice traffic independently of the control-plane TCP connection.
+func (b *udpBind) SetMark(mark int) (err os.Error) {
+	for _, conn := range []*net.UDPConn{b.ipv4, b.ipv6} {
+		if conn == nil {
+			continue
+		}
+		file, err := conn.File()
+		if err != nil {
+			return err
+		}
+		err = syscall.SetsockoptInt(file.Fd(), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		file.Close()
+		if err != nil {
+			return os.NewError(err.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+// grumblectl is a small CLI for the grumble control-plane RPC. It talks
+// to a running grumble process over its Unix control socket instead of
+// requiring Ice or DBus bindings the way Murmur's tools do.
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"goprotobuf.googlecode.com/hg/proto"
+	"io"
+	"mumbleproto"
+	"net"
+	"os"
+)
+
+// Control-plane request kinds. Must match the ControlXxx constants in
+// control.go.
+const (
+	ControlListVirtualServers uint16 = iota
+	ControlListUsers
+	ControlKickUser
+	ControlBanUser
+	ControlSendTextMessage
+	ControlGetServerConfig
+	ControlSetServerConfig
+	ControlShutdown
+	ControlListRegistrations
+	ControlRenameRegistration
+	ControlRevokeRegistration
+)
+
+var socketPath = flag.String("socket", "/var/run/grumble.sock", "path to the grumble control socket")
+var secret = flag.String("secret", "", "shared secret for the control socket, if configured")
+var serverId = flag.Int64("server", 0, "virtual server id to operate on")
+
+func dial() net.Conn {
+	conn, err := net.Dial("unix", *socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "grumblectl: unable to connect to %v: %v\n", *socketPath, err)
+		os.Exit(1)
+	}
+	return conn
+}
+
+func call(kind uint16, payload []byte) *mumbleproto.ControlResponse {
+	conn := dial()
+	defer conn.Close()
+
+	req := &mumbleproto.ControlRequest{
+		Kind:     proto.Uint32(uint32(kind)),
+		ServerId: proto.Int64(*serverId),
+		Payload:  payload,
+	}
+	if *secret != "" {
+		req.Secret = proto.String(*secret)
+	}
+
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "grumblectl: unable to marshal request: %v\n", err)
+		os.Exit(1)
+	}
+
+	binary.Write(conn, binary.BigEndian, uint32(len(buf)))
+	conn.Write(buf)
+
+	var length uint32
+	err = binary.Read(conn, binary.BigEndian, &length)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "grumblectl: no reply from server: %v\n", err)
+		os.Exit(1)
+	}
+
+	resp := make([]byte, length)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "grumblectl: short read from server: %v\n", err)
+		os.Exit(1)
+	}
+
+	reply := &mumbleproto.ControlResponse{}
+	proto.Unmarshal(resp, reply)
+	return reply
+}
+
+func main() {
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: grumblectl [flags] <list-servers|list-users|kick|ban|get-config|set-max-users|say|shutdown|list-registrations|rename-registration|revoke-registration> [args...]")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list-servers":
+		reply := call(ControlListVirtualServers, nil)
+		for _, id := range reply.ServerIds {
+			fmt.Println(id)
+		}
+
+	case "list-users":
+		reply := call(ControlListUsers, nil)
+		payload := &mumbleproto.UserList{}
+		proto.Unmarshal(reply.Payload, payload)
+		for _, name := range payload.Names {
+			fmt.Println(name)
+		}
+
+	case "kick":
+		if len(args) < 3 {
+			fmt.Fprintln(os.Stderr, "usage: grumblectl kick <session> <reason>")
+			os.Exit(1)
+		}
+		var session uint32
+		fmt.Sscanf(args[1], "%d", &session)
+		payload, _ := proto.Marshal(&mumbleproto.KickUser{
+			Session: proto.Uint32(session),
+			Reason:  proto.String(args[2]),
+		})
+		call(ControlKickUser, payload)
+
+	case "ban":
+		if len(args) < 3 {
+			fmt.Fprintln(os.Stderr, "usage: grumblectl ban <session> <duration-seconds>")
+			os.Exit(1)
+		}
+		var session uint32
+		var duration int64
+		fmt.Sscanf(args[1], "%d", &session)
+		fmt.Sscanf(args[2], "%d", &duration)
+		payload, _ := proto.Marshal(&mumbleproto.BanUser{
+			Session:  proto.Uint32(session),
+			Duration: proto.Int64(duration),
+		})
+		call(ControlBanUser, payload)
+
+	case "get-config":
+		reply := call(ControlGetServerConfig, nil)
+		payload := &mumbleproto.ControlServerConfig{}
+		proto.Unmarshal(reply.Payload, payload)
+		fmt.Printf("max-users: %d\n", payload.GetMaxUsers())
+		fmt.Printf("max-bandwidth: %d\n", payload.GetMaxBandwidth())
+		fmt.Printf("rekey-interval: %d\n", payload.GetRekeyInterval())
+		fmt.Printf("require-certificate: %v\n", payload.GetRequireCertificate())
+
+	case "set-max-users":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "usage: grumblectl set-max-users <n>")
+			os.Exit(1)
+		}
+		var maxUsers int32
+		fmt.Sscanf(args[1], "%d", &maxUsers)
+		payload, _ := proto.Marshal(&mumbleproto.ControlServerConfig{MaxUsers: proto.Int32(maxUsers)})
+		call(ControlSetServerConfig, payload)
+
+	case "say":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "usage: grumblectl say <text>")
+			os.Exit(1)
+		}
+		payload, _ := proto.Marshal(&mumbleproto.ControlTextMessage{Text: proto.String(args[1])})
+		call(ControlSendTextMessage, payload)
+
+	case "shutdown":
+		call(ControlShutdown, nil)
+
+	case "list-registrations":
+		reply := call(ControlListRegistrations, nil)
+		payload := &mumbleproto.RegisteredUserList{}
+		proto.Unmarshal(reply.Payload, payload)
+		for i, name := range payload.Names {
+			fmt.Printf("%s\t%s\n", payload.Hashes[i], name)
+		}
+
+	case "rename-registration":
+		if len(args) < 3 {
+			fmt.Fprintln(os.Stderr, "usage: grumblectl rename-registration <hash> <name>")
+			os.Exit(1)
+		}
+		hash, err := hex.DecodeString(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "grumblectl: invalid hash %q: %v\n", args[1], err)
+			os.Exit(1)
+		}
+		payload, _ := proto.Marshal(&mumbleproto.RenameRegistration{
+			Hash: hash,
+			Name: proto.String(args[2]),
+		})
+		reply := call(ControlRenameRegistration, payload)
+		if reply.Error != nil {
+			fmt.Fprintf(os.Stderr, "grumblectl: %s\n", reply.GetError())
+			os.Exit(1)
+		}
+
+	case "revoke-registration":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "usage: grumblectl revoke-registration <hash>")
+			os.Exit(1)
+		}
+		hash, err := hex.DecodeString(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "grumblectl: invalid hash %q: %v\n", args[1], err)
+			os.Exit(1)
+		}
+		payload, _ := proto.Marshal(&mumbleproto.RevokeRegistration{Hash: hash})
+		reply := call(ControlRevokeRegistration, payload)
+		if reply.Error != nil {
+			fmt.Fprintf(os.Stderr, "grumblectl: %s\n", reply.GetError())
+			os.Exit(1)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "grumblectl: unknown command %q\n", args[0])
+		os.Exit(1)
+	}
+}
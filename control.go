@@ -0,0 +1,292 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"encoding/binary"
+	"goprotobuf.googlecode.com/hg/proto"
+	"io"
+	"log"
+	"mumbleproto"
+	"net"
+	"os"
+)
+
+// Default location of the control-plane Unix socket. Murmur uses Ice or
+// DBus for this; we don't want to drag either of those in, so we speak a
+// small length-prefixed protobuf protocol instead (see grumblectl).
+const DefaultControlSocket = "/var/run/grumble.sock"
+
+// Control-plane request kinds, carried in mumbleproto.ControlRequest.Kind.
+// ControlAddChannel/ControlRemoveChannel were dropped: grumble only ever
+// exposes the single hardcoded Root channel, so there's no channel tree
+// for those requests to operate on.
+const (
+	ControlListVirtualServers uint16 = iota
+	ControlListUsers
+	ControlKickUser
+	ControlBanUser
+	ControlSendTextMessage
+	ControlGetServerConfig
+	ControlSetServerConfig
+	ControlShutdown
+	ControlListRegistrations
+	ControlRenameRegistration
+	ControlRevokeRegistration
+)
+
+// A ControlMessage is posted onto a virtual server's control channel so
+// the mutation it describes is serialized on that server's handler
+// goroutine, the same as client traffic on incoming. reply carries the
+// full response (not just a payload) so handleControlMessage can report
+// a failure (e.g. a name collision) back to the caller instead of only
+// ever answering with success.
+type ControlMessage struct {
+	kind  uint16
+	buf   []byte
+	reply chan *mumbleproto.ControlResponse
+}
+
+// ControlServer accepts admin connections on a Unix socket and dispatches
+// them to the virtual server, registered with its Meta, that each request
+// names. A Server that isn't registered with a Meta can't be reached.
+type ControlServer struct {
+	meta     *Meta
+	path     string
+	secret   string
+	listener net.Listener
+}
+
+// NewControlServer prepares a control-plane listener. secret may be empty,
+// in which case the socket is authenticated by filesystem permissions
+// alone.
+func NewControlServer(meta *Meta, path string, secret string) *ControlServer {
+	if path == "" {
+		path = DefaultControlSocket
+	}
+	return &ControlServer{meta: meta, path: path, secret: secret}
+}
+
+// ListenAndServe opens the control socket and serves connections until
+// the process exits.
+func (c *ControlServer) ListenAndServe() (err os.Error) {
+	os.Remove(c.path)
+
+	c.listener, err = net.Listen("unix", c.path)
+	if err != nil {
+		return err
+	}
+	os.Chmod(c.path, 0600)
+
+	log.Printf("control: listening on %v", c.path)
+
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			log.Printf("control: unable to accept()")
+			continue
+		}
+		go c.handle(conn)
+	}
+
+	panic("unreachable")
+}
+
+// handle services one control-plane connection: each request is a
+// uint32 big-endian length followed by a marshaled mumbleproto.ControlRequest,
+// and each reply is framed the same way.
+func (c *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var length uint32
+		err := binary.Read(conn, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+
+		buf := make([]byte, length)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return
+		}
+
+		req := &mumbleproto.ControlRequest{}
+		err = proto.Unmarshal(buf, req)
+		if err != nil {
+			log.Printf("control: unable to unmarshal request")
+			return
+		}
+
+		if c.secret != "" && req.GetSecret() != c.secret {
+			log.Printf("control: rejected request with bad secret")
+			return
+		}
+
+		reply := c.dispatch(req)
+
+		out, err := proto.Marshal(reply)
+		if err != nil {
+			return
+		}
+
+		binary.Write(conn, binary.BigEndian, uint32(len(out)))
+		conn.Write(out)
+	}
+}
+
+// dispatch routes a control request to the virtual server it names and
+// waits for the handler goroutine to produce a reply. ListVirtualServers
+// is answered directly, since it doesn't belong to any one server.
+func (c *ControlServer) dispatch(req *mumbleproto.ControlRequest) *mumbleproto.ControlResponse {
+	if req.GetKind() == uint32(ControlListVirtualServers) {
+		ids := make([]int64, 0)
+		for _, s := range c.meta.Servers() {
+			ids = append(ids, s.id)
+		}
+		return &mumbleproto.ControlResponse{ServerIds: ids}
+	}
+
+	var target *Server
+	for _, s := range c.meta.Servers() {
+		if s.id == req.GetServerId() {
+			target = s
+			break
+		}
+	}
+	if target == nil {
+		return &mumbleproto.ControlResponse{Error: proto.String("no such server")}
+	}
+	if !target.Started() {
+		// target.control is only ever drained by handler(), which Start
+		// launches and Stop's close(server.stop) retires; posting to it
+		// for a registered-but-not-started (or already stopped) virtual
+		// server would block this dispatch -- and so the calling client
+		// connection's handle goroutine -- forever.
+		return &mumbleproto.ControlResponse{Error: proto.String("server not started")}
+	}
+
+	msg := &ControlMessage{
+		kind:  uint16(req.GetKind()),
+		buf:   req.GetPayload(),
+		reply: make(chan *mumbleproto.ControlResponse, 1),
+	}
+	target.control <- msg
+
+	return <-msg.reply
+}
+
+// handleControlMessage runs on the Server's own handler goroutine (see
+// Server.handler), so it can mutate client/channel state without racing
+// client traffic.
+func (server *Server) handleControlMessage(msg *ControlMessage) {
+	resp := &mumbleproto.ControlResponse{}
+
+	switch msg.kind {
+	case ControlListUsers:
+		names := make([]string, 0)
+		server.cmutex.RLock()
+		for _, client := range server.clients {
+			if client.state == StateClientAuthenticated {
+				names = append(names, client.Username)
+			}
+		}
+		server.cmutex.RUnlock()
+		resp.Payload, _ = proto.Marshal(&mumbleproto.UserList{Names: names})
+
+	case ControlKickUser:
+		req := &mumbleproto.KickUser{}
+		proto.Unmarshal(msg.buf, req)
+		if client := server.getClientConnection(req.GetSession()); client != nil {
+			client.Panic(req.GetReason())
+			server.removeClient(client)
+		}
+
+	case ControlBanUser:
+		req := &mumbleproto.BanUser{}
+		proto.Unmarshal(msg.buf, req)
+		if client := server.getClientConnection(req.GetSession()); client != nil && client.tcpaddr != nil {
+			server.ban(client.tcpaddr.IP, req.GetDuration())
+			client.Panic("You have been banned from this server.")
+			server.removeClient(client)
+		}
+
+	case ControlSendTextMessage:
+		req := &mumbleproto.ControlTextMessage{}
+		proto.Unmarshal(msg.buf, req)
+		server.broadcastProtoMessage(MessageTextMessage, &mumbleproto.TextMessage{
+			Message: proto.String(req.GetText()),
+		})
+
+	case ControlShutdown:
+		// Stop actually retires the server (background goroutines,
+		// accept-via-Meta dispatch) instead of just kicking whoever's
+		// currently connected, which left it free to accept the very
+		// next reconnect.
+		server.Stop()
+
+	case ControlListRegistrations:
+		if server.registration != nil {
+			names := make([]string, 0)
+			hashes := make([]string, 0)
+			for _, entry := range server.registration.List() {
+				names = append(names, entry.User.Name)
+				hashes = append(hashes, entry.Id.String())
+			}
+			resp.Payload, _ = proto.Marshal(&mumbleproto.RegisteredUserList{Names: names, Hashes: hashes})
+		}
+
+	case ControlRenameRegistration:
+		req := &mumbleproto.RenameRegistration{}
+		proto.Unmarshal(msg.buf, req)
+		if server.registration != nil {
+			var id NodeID
+			copy(id[0:], req.GetHash())
+			if err := server.registration.Rename(id, req.GetName()); err != nil {
+				resp.Error = proto.String(err.String())
+			}
+		}
+
+	case ControlRevokeRegistration:
+		req := &mumbleproto.RevokeRegistration{}
+		proto.Unmarshal(msg.buf, req)
+		if server.registration != nil {
+			var id NodeID
+			copy(id[0:], req.GetHash())
+			if err := server.registration.Revoke(id); err != nil {
+				resp.Error = proto.String(err.String())
+			}
+		}
+
+	case ControlGetServerConfig:
+		resp.Payload, _ = proto.Marshal(&mumbleproto.ControlServerConfig{
+			MaxUsers:           proto.Int32(int32(server.MaxUsers)),
+			MaxBandwidth:       proto.Uint32(server.MaxBandwidth),
+			RekeyInterval:      proto.Int64(server.RekeyInterval),
+			RequireCertificate: proto.Bool(server.RequireCertificate),
+		})
+
+	case ControlSetServerConfig:
+		req := &mumbleproto.ControlServerConfig{}
+		proto.Unmarshal(msg.buf, req)
+		if req.MaxUsers != nil {
+			server.MaxUsers = int(req.GetMaxUsers())
+		}
+		if req.MaxBandwidth != nil {
+			server.MaxBandwidth = req.GetMaxBandwidth()
+		}
+		if req.RekeyInterval != nil {
+			server.RekeyInterval = req.GetRekeyInterval()
+		}
+		if req.RequireCertificate != nil {
+			server.RequireCertificate = req.GetRequireCertificate()
+		}
+
+	default:
+		log.Printf("control: unhandled request kind %v", msg.kind)
+	}
+
+	msg.reply <- resp
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"testing"
+)
+
+// TestControlServerDispatch exercises the guards ControlServer.dispatch
+// runs before ever touching a virtual server's control channel: an
+// unknown server id and a registered-but-not-started server must both
+// answer with an Error instead of blocking forever on an unbuffered
+// channel nothing is draining yet. Once the server is actually started,
+// dispatch should round-trip a request through its handler goroutine.
+func TestControlServerDispatch(t *testing.T) {
+	meta := NewMeta()
+	s, err := meta.NewServer(1, ServerConfig{Address: "a.example.com", Port: 0})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	cs := NewControlServer(meta, "", "")
+
+	req := &mumbleproto.ControlRequest{
+		Kind:     proto.Uint32(uint32(ControlListUsers)),
+		ServerId: proto.Int64(99),
+	}
+	if resp := cs.dispatch(req); resp.GetError() == "" {
+		t.Fatalf("dispatch() against an unknown server id returned no error")
+	}
+
+	req.ServerId = proto.Int64(1)
+	if resp := cs.dispatch(req); resp.GetError() == "" {
+		t.Fatalf("dispatch() against a registered-but-not-started server returned no error")
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	resp := cs.dispatch(req)
+	if resp.Error != nil {
+		t.Fatalf("dispatch() against a started server returned an error: %v", resp.GetError())
+	}
+
+	payload := &mumbleproto.UserList{}
+	if err := proto.Unmarshal(resp.Payload, payload); err != nil {
+		t.Fatalf("proto.Unmarshal: %v", err)
+	}
+}
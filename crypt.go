@@ -0,0 +1,237 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"cryptstate"
+	"goprotobuf.googlecode.com/hg/proto"
+	"log"
+	"mumbleproto"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRekeyInterval is how often a client's CryptState is rotated,
+// bounding the number of packets ever encrypted under one OCB2-AES key
+// well below the ~2^32 packets after which the cipher's nonce space would
+// otherwise be exhausted.
+const DefaultRekeyInterval = 60 * 60e9 // 1 hour, in nanoseconds
+
+// handleCryptSetup implements the CryptSetup exchange in both
+// directions: a client may send one unprompted to request a resync (only
+// ClientNonce set, because it noticed too many Late/Lost packets), and a
+// client must send one back, echoing ClientNonce, to acknowledge a
+// server-initiated rekey (see Server.rekeyLoop).
+func (server *Server) handleCryptSetup(client *ClientConnection, msg *Message) {
+	cs := &mumbleproto.CryptSetup{}
+	err := proto.Unmarshal(msg.buf, cs)
+	if err != nil {
+		client.Panic("Unable to unmarshal CryptSetup message.")
+		return
+	}
+
+	// A ClientNonce-only message that matches a pending rekey's nonce is
+	// that rekey's acknowledgement, handled below, not a resync request.
+	client.cryptMutex.RLock()
+	offered := client.pendingCrypt
+	client.cryptMutex.RUnlock()
+	isAck := offered != nil && cs.ClientNonce != nil && bytesEqual(cs.ClientNonce, offered.DecryptIV[0:])
+
+	// Client-requested resync: no key, just ask for a fresh ServerNonce
+	// under the existing key.
+	if cs.Key == nil && cs.ServerNonce == nil && !isAck {
+		atomic.AddUint32(&client.cryptResync, 1)
+		err = client.sendProtoMessage(MessageCryptSetup, &mumbleproto.CryptSetup{
+			ServerNonce: client.crypt.EncryptIV[0:],
+		})
+		if err != nil {
+			client.Panic(err.String())
+		}
+		return
+	}
+
+	// Otherwise this should be the client's acknowledgement of a
+	// server-initiated rekey: the ClientNonce it echoes back must match
+	// the one we sent with the pending CryptState. client.crypt is read
+	// by listenUDP/SendUDP on other goroutines for every voice packet, so
+	// the check-and-swap has to happen under cryptMutex.
+	client.cryptMutex.Lock()
+	pending := client.pendingCrypt
+	if pending == nil {
+		client.cryptMutex.Unlock()
+		log.Printf("crypt: unexpected CryptSetup ack from client with no pending rekey")
+		return
+	}
+	if cs.ClientNonce == nil || !bytesEqual(cs.ClientNonce, pending.DecryptIV[0:]) {
+		client.cryptMutex.Unlock()
+		log.Printf("crypt: CryptSetup ack nonce mismatch, discarding rekey")
+		return
+	}
+
+	client.crypt = pending
+	client.pendingCrypt = nil
+	client.cryptMutex.Unlock()
+
+	atomic.StoreUint32(&client.cryptGood, 0)
+	atomic.StoreUint32(&client.cryptLate, 0)
+	atomic.StoreUint32(&client.cryptLost, 0)
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// handleUserStatsMessage answers a client's UserStats request with the
+// real counters we've been tracking, rather than an empty reply.
+func (server *Server) handleUserStatsMessage(client *ClientConnection, msg *Message) {
+	req := &mumbleproto.UserStats{}
+	err := proto.Unmarshal(msg.buf, req)
+	if err != nil {
+		client.Panic("Unable to unmarshal UserStats message.")
+		return
+	}
+
+	target := client
+	if req.Session != nil {
+		if other := server.getClientConnection(*req.Session); other != nil {
+			target = other
+		}
+	}
+
+	stats := &mumbleproto.UserStats{
+		Session: proto.Uint32(target.Session),
+		Good:    proto.Uint32(atomic.LoadUint32(&target.cryptGood)),
+		Late:    proto.Uint32(atomic.LoadUint32(&target.cryptLate)),
+		Lost:    proto.Uint32(atomic.LoadUint32(&target.cryptLost)),
+		Resync:  proto.Uint32(atomic.LoadUint32(&target.cryptResync)),
+	}
+
+	if target.tcpaddr != nil {
+		stats.Address = []byte(target.tcpaddr.IP)
+	}
+
+	if server.PreferAlphaCodec {
+		stats.CeltVersions = []int32{server.AlphaCodec}
+	} else {
+		stats.CeltVersions = []int32{server.BetaCodec}
+	}
+
+	err = client.sendProtoMessage(MessageUserStats, stats)
+	if err != nil {
+		client.Panic(err.String())
+	}
+}
+
+// RekeyPacketLimit bounds how many packets may be encrypted under a
+// single CryptState before rekeyLoop forces an early rotation,
+// independent of RekeyInterval -- a busy client could otherwise reach
+// OCB2-AES's ~2^32-packet nonce-exhaustion window well before the
+// wall-clock timer next fires.
+const RekeyPacketLimit = 1 << 24
+
+// rekeyCheckInterval is how often rekeyLoop wakes to check whether any
+// client is due for a rotation. It has to be much finer-grained than
+// RekeyInterval itself, since that's what lets RekeyPacketLimit trigger
+// promptly instead of waiting for the next interval-based sweep.
+const rekeyCheckInterval = 10e9 // 10 seconds, in nanoseconds
+
+// rekeyLoop periodically rotates a connected client's CryptState, once
+// per RekeyInterval or after RekeyPacketLimit packets under the current
+// key, whichever comes first, closing the nonce-exhaustion window
+// OCB2-AES has after ~2^32 packets under a single key.
+func (server *Server) rekeyLoop(interval int64) {
+	if interval <= 0 {
+		interval = DefaultRekeyInterval
+	}
+
+	for {
+		select {
+		case <-time.After(rekeyCheckInterval):
+		case <-server.stop:
+			return
+		}
+
+		server.cmutex.RLock()
+		clients := make([]*ClientConnection, len(server.clients))
+		copy(clients, server.clients)
+		server.cmutex.RUnlock()
+
+		now := time.Nanoseconds()
+		for _, client := range clients {
+			if client.state != StateClientAuthenticated {
+				continue
+			}
+
+			if client.rekeyInFlight() {
+				// A rekey offer is already outstanding. cryptGood isn't
+				// reset until handleCryptSetup processes the client's ack,
+				// so busy below would otherwise stay true the whole time
+				// the ack is in flight, and we'd keep overwriting
+				// pendingCrypt with a fresh offer every tick -- which the
+				// client's eventual, now-stale ack would then fail to
+				// match and get discarded, repeating forever for a client
+				// whose RTT exceeds rekeyCheckInterval.
+				continue
+			}
+
+			due := now-atomic.LoadInt64(&client.lastRekey) >= interval
+			busy := atomic.LoadUint32(&client.cryptGood) >= RekeyPacketLimit
+			if due || busy {
+				server.rekeyClient(client)
+			}
+		}
+	}
+}
+
+// rekeyInFlight reports whether client has a server-initiated rekey
+// offer outstanding, awaiting the client's CryptSetup ack.
+func (client *ClientConnection) rekeyInFlight() bool {
+	client.cryptMutex.RLock()
+	defer client.cryptMutex.RUnlock()
+	return client.pendingCrypt != nil
+}
+
+func (server *Server) rekeyClient(client *ClientConnection) (err os.Error) {
+	fresh, err := cryptstate.New()
+	if err != nil {
+		return err
+	}
+	err = fresh.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	// Record the attempt now, not on ack, so a client that's slow to
+	// acknowledge doesn't get a fresh CryptSetup resent on every
+	// rekeyCheckInterval tick in the meantime.
+	atomic.StoreInt64(&client.lastRekey, time.Nanoseconds())
+
+	client.cryptMutex.Lock()
+	client.pendingCrypt = fresh
+	client.cryptMutex.Unlock()
+
+	err = client.sendProtoMessage(MessageCryptSetup, &mumbleproto.CryptSetup{
+		Key:         fresh.RawKey[0:],
+		ClientNonce: fresh.DecryptIV[0:],
+		ServerNonce: fresh.EncryptIV[0:],
+	})
+	if err != nil {
+		client.cryptMutex.Lock()
+		client.pendingCrypt = nil
+		client.cryptMutex.Unlock()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"testing"
+)
+
+// newRekeyTestClient builds a ClientConnection with a real CryptState and a
+// drained msgchan, enough for rekeyClient/handleCryptSetup to run against.
+func newRekeyTestClient(t *testing.T) *ClientConnection {
+	client := newTestClient(t)
+	client.state = StateClientAuthenticated
+	client.msgchan = make(chan *Message, 4)
+
+	go func() {
+		for _ = range client.msgchan {
+		}
+	}()
+
+	return client
+}
+
+// TestRekeyInFlight exercises the ack round-trip rekeyLoop depends on to
+// avoid re-offering a fresh key every tick while a slow client is still
+// acknowledging the first one: rekeyClient should mark a rekey in flight,
+// and only handleCryptSetup processing a matching ack should clear it.
+func TestRekeyInFlight(t *testing.T) {
+	server, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	client := newRekeyTestClient(t)
+
+	if client.rekeyInFlight() {
+		t.Fatalf("rekeyInFlight() = true before any rekey was offered")
+	}
+
+	if err := server.rekeyClient(client); err != nil {
+		t.Fatalf("rekeyClient: %v", err)
+	}
+	if !client.rekeyInFlight() {
+		t.Fatalf("rekeyInFlight() = false right after rekeyClient offered a key")
+	}
+
+	client.cryptMutex.RLock()
+	pending := client.pendingCrypt
+	client.cryptMutex.RUnlock()
+
+	buf, err := proto.Marshal(&mumbleproto.CryptSetup{ClientNonce: pending.DecryptIV[0:]})
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	server.handleCryptSetup(client, &Message{client: client, buf: buf})
+
+	if client.rekeyInFlight() {
+		t.Fatalf("rekeyInFlight() = true after a matching ack was processed")
+	}
+	if client.crypt != pending {
+		t.Fatalf("handleCryptSetup did not install the offered CryptState")
+	}
+}
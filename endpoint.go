@@ -0,0 +1,94 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// A Bind abstracts the underlying socket(s) used for voice traffic. The
+// default implementation, udpBind, keeps separate IPv4 and IPv6 sockets
+// and can apply SO_MARK to them; the interface lets the whole thing be
+// swapped out (e.g. for DTLS) without touching the dispatch code in
+// Server.ListenUDP.
+type Bind interface {
+	// Send writes buf to the endpoint's cached destination address.
+	Send(buf []byte, dst *Endpoint) os.Error
+	// ReceiveIPv4 reads a single IPv4 datagram into buf.
+	ReceiveIPv4(buf []byte) (nread int, src *Endpoint, err os.Error)
+	// ReceiveIPv6 reads a single IPv6 datagram into buf.
+	ReceiveIPv6(buf []byte) (nread int, src *Endpoint, err os.Error)
+	Close() os.Error
+	// SetMark applies SO_MARK to the underlying socket(s), so outbound
+	// voice traffic can be routed or shaped independently of TCP.
+	SetMark(mark int) os.Error
+}
+
+// An Endpoint identifies one side of a UDP voice conversation. It caches
+// the remote address a client is known to be reachable at (dst) as well
+// as the local address we last received a packet on (src), so replies go
+// back out the same interface the client's traffic arrived on.
+type Endpoint struct {
+	dst *net.UDPAddr
+	src net.IP
+}
+
+// NewEndpoint creates an Endpoint for the given remote UDP address. src is
+// not yet known and will be filled in the first time a packet is received
+// from this endpoint.
+func NewEndpoint(dst *net.UDPAddr) *Endpoint {
+	return &Endpoint{dst: dst}
+}
+
+// ClearSrc forgets the cached local source address, forcing it to be
+// re-selected (e.g. by the kernel's routing table) the next time we send
+// to this endpoint.
+func (e *Endpoint) ClearSrc() {
+	e.src = nil
+}
+
+// DstIP returns the remote address this endpoint sends to.
+func (e *Endpoint) DstIP() net.IP {
+	return e.dst.IP
+}
+
+// SrcIP returns the cached local address packets to this endpoint should
+// originate from, or nil if none has been recorded yet.
+func (e *Endpoint) SrcIP() net.IP {
+	return e.src
+}
+
+// SetSrcIP records the local address a packet from this endpoint arrived
+// on, so replies can be routed back out the same interface.
+func (e *Endpoint) SetSrcIP(ip net.IP) {
+	e.src = ip
+}
+
+// Bytes returns a canonical byte serialization of the endpoint's remote
+// address, suitable for use as a map key or for wire serialization.
+func (e *Endpoint) Bytes() []byte {
+	if ip4 := e.dst.IP.To4(); ip4 != nil {
+		buf := make([]byte, 6)
+		copy(buf, ip4)
+		buf[4] = byte(e.dst.Port >> 8)
+		buf[5] = byte(e.dst.Port)
+		return buf
+	}
+	ip6 := e.dst.IP.To16()
+	buf := make([]byte, 18)
+	copy(buf, ip6)
+	buf[16] = byte(e.dst.Port >> 8)
+	buf[17] = byte(e.dst.Port)
+	return buf
+}
+
+// String returns the canonical form of the endpoint's remote address. It
+// is used as the key into Server.endpoints, so lookups are a single hash
+// operation instead of a linear scan of connected clients.
+func (e *Endpoint) String() string {
+	return fmt.Sprintf("%x", e.Bytes())
+}
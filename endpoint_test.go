@@ -0,0 +1,105 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"cryptstate"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestEndpointMigration(t *testing.T) {
+	a := NewEndpoint(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 60001})
+	roamed := NewEndpoint(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 60001})
+	if a.String() != roamed.String() {
+		t.Fatalf("endpoints with the same remote address should share a cache key")
+	}
+
+	moved := NewEndpoint(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 60002})
+	if a.String() == moved.String() {
+		t.Fatalf("endpoints on different ports should not share a cache key")
+	}
+}
+
+// newTestClient builds a ClientConnection with a real, freshly-generated
+// CryptState, so its traffic can actually be encrypted/decrypted the way
+// Server.decryptVoicePacket expects.
+func newTestClient(t *testing.T) *ClientConnection {
+	cs, err := cryptstate.New()
+	if err != nil {
+		t.Fatalf("cryptstate.New: %v", err)
+	}
+	if err := cs.GenerateKey(); err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	client := new(ClientConnection)
+	client.crypt = cs
+	client.cryptMutex = new(sync.RWMutex)
+	return client
+}
+
+// TestEndpointRouteRekey exercises the stale-route fallback in
+// Server.decryptVoicePacket: an Endpoint cached against one client should
+// be re-bound to whichever client can actually decrypt the next packet
+// from it, rather than staying stuck on a client that no longer can (the
+// scenario that occurs when a client roams and reconnects under a fresh
+// CryptState while keeping the same NAT-mapped source port).
+func TestEndpointRouteRekey(t *testing.T) {
+	server, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	ep := NewEndpoint(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 60001})
+
+	stale := newTestClient(t)
+	server.bindEndpoint(ep, stale)
+
+	if got := server.lookupEndpoint(ep); got != stale {
+		t.Fatalf("lookupEndpoint() = %v, want the stale client", got)
+	}
+
+	fresh := newTestClient(t)
+	server.cmutex.Lock()
+	server.clients = append(server.clients, fresh)
+	server.cmutex.Unlock()
+
+	plaintext := []byte("this is a voice frame")
+	crypted := make([]byte, len(plaintext)+4)
+	fresh.crypt.Encrypt(plaintext, crypted)
+
+	match, plain := server.decryptVoicePacket(crypted, ep)
+	if match != fresh {
+		t.Fatalf("decryptVoicePacket() matched %v, want the fresh client", match)
+	}
+	if string(plain) != string(plaintext) {
+		t.Fatalf("decryptVoicePacket() plaintext = %q, want %q", plain, plaintext)
+	}
+
+	if got := server.lookupEndpoint(ep); got != fresh {
+		t.Fatalf("lookupEndpoint() after stale-route fallback = %v, want the cache updated to the fresh client", got)
+	}
+}
+
+func TestEndpointSrcIP(t *testing.T) {
+	e := NewEndpoint(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 60001})
+
+	if e.SrcIP() != nil {
+		t.Fatalf("expected no cached source address on a fresh endpoint")
+	}
+
+	src := net.ParseIP("198.51.100.7")
+	e.SetSrcIP(src)
+	if !e.SrcIP().Equal(src) {
+		t.Fatalf("SrcIP() = %v, want %v", e.SrcIP(), src)
+	}
+
+	e.ClearSrc()
+	if e.SrcIP() != nil {
+		t.Fatalf("expected ClearSrc to forget the cached source address")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A NodeID is a durable identity for a client, derived from the SHA-256
+// hash of its TLS certificate's SubjectPublicKeyInfo. Unlike a username,
+// it survives a client renaming itself, and unlike a session id, it
+// survives a reconnect.
+type NodeID [sha256.Size]byte
+
+// NewNodeID computes the NodeID for a client's presented certificate.
+func NewNodeID(cert *x509.Certificate) NodeID {
+	return NodeID(sha256.Sum256(cert.RawSubjectPublicKeyInfo))
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[0:])
+}
+
+// A RegisteredUser is a NodeID that has claimed a name on this server.
+type RegisteredUser struct {
+	UserId    uint32
+	Name      string
+	ACLGroups []string
+	LastSeen  int64
+}
+
+var registeredUsersBucket = []byte("registered-users")
+
+// Registration persists the NodeID -> RegisteredUser mapping to disk, so
+// a client's identity (and the name it's entitled to) survives a server
+// restart.
+type Registration struct {
+	db     *bolt.DB
+	mutex  *sync.Mutex
+	nextId uint32
+}
+
+// NewRegistration opens (creating if necessary) the registration database
+// at path.
+func NewRegistration(path string) (r *Registration, err os.Error) {
+	db, dberr := bolt.Open(path, 0600, nil)
+	if dberr != nil {
+		return nil, os.NewError(dberr.Error())
+	}
+
+	var maxId uint32
+
+	dberr = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(registeredUsersBucket)
+		if err != nil {
+			return err
+		}
+
+		// Seed nextId from whatever's already on disk, so a restart
+		// doesn't hand out a UserId that collides with an existing
+		// registration.
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if user := decodeRegisteredUser(v); user.UserId > maxId {
+				maxId = user.UserId
+			}
+		}
+
+		return nil
+	})
+	if dberr != nil {
+		return nil, os.NewError(dberr.Error())
+	}
+
+	r = &Registration{db: db, mutex: new(sync.Mutex), nextId: maxId}
+	return r, nil
+}
+
+// Lookup returns the RegisteredUser for id, if one has claimed a name.
+func (r *Registration) Lookup(id NodeID) (user *RegisteredUser) {
+	r.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(registeredUsersBucket).Get(id[0:])
+		if buf != nil {
+			user = decodeRegisteredUser(buf)
+		}
+		return nil
+	})
+	return user
+}
+
+// ByName returns the NodeID currently holding name, if any.
+func (r *Registration) ByName(name string) (id NodeID, user *RegisteredUser) {
+	r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(registeredUsersBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			candidate := decodeRegisteredUser(v)
+			if candidate.Name == name {
+				copy(id[0:], k)
+				user = candidate
+				return nil
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Register claims name for id. Callers must have already confirmed the
+// name is free (see Server.handleAuthenticate).
+func (r *Registration) Register(id NodeID, name string) (user *RegisteredUser, err os.Error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.nextId++
+	user = &RegisteredUser{UserId: r.nextId, Name: name}
+
+	dberr := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(registeredUsersBucket).Put(id[0:], encodeRegisteredUser(user))
+	})
+	if dberr != nil {
+		return nil, os.NewError(dberr.Error())
+	}
+
+	return user, nil
+}
+
+// Rename changes the name registered to id. It fails if name is already
+// registered to a different NodeID, mirroring the collision check
+// Server.handleAuthenticate does for auto-registration -- without it, an
+// operator could rename two different NodeIDs onto the same name, and
+// the next connecting client would get whichever one ByName's cursor
+// scan happened to see first.
+func (r *Registration) Rename(id NodeID, name string) os.Error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	user := r.Lookup(id)
+	if user == nil {
+		return os.NewError("registration: no such user")
+	}
+
+	if owner, existing := r.ByName(name); existing != nil && owner != id {
+		return os.NewError("registration: name already registered to another certificate")
+	}
+
+	user.Name = name
+
+	dberr := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(registeredUsersBucket).Put(id[0:], encodeRegisteredUser(user))
+	})
+	if dberr != nil {
+		return os.NewError(dberr.Error())
+	}
+	return nil
+}
+
+// Revoke removes id's registration entirely, freeing its name.
+func (r *Registration) Revoke(id NodeID) os.Error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	dberr := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(registeredUsersBucket).Delete(id[0:])
+	})
+	if dberr != nil {
+		return os.NewError(dberr.Error())
+	}
+	return nil
+}
+
+// RegisteredEntry pairs a RegisteredUser with the NodeID that owns it.
+// List needs to surface the NodeID (not just tracked by RegisteredUser)
+// so callers like the control-plane's list-registrations can report the
+// hash rename-registration/revoke-registration need to target a user.
+type RegisteredEntry struct {
+	Id   NodeID
+	User *RegisteredUser
+}
+
+// List returns every registered user, for the control-plane's
+// list-registrations call.
+func (r *Registration) List() (entries []RegisteredEntry) {
+	r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(registeredUsersBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var id NodeID
+			copy(id[0:], k)
+			entries = append(entries, RegisteredEntry{Id: id, User: decodeRegisteredUser(v)})
+		}
+		return nil
+	})
+	return
+}
+
+// encodeRegisteredUser and decodeRegisteredUser encode just enough of a
+// RegisteredUser to answer Lookup/ByName; ACLGroups and LastSeen aren't
+// needed until the control plane grows ACL management.
+func encodeRegisteredUser(u *RegisteredUser) []byte {
+	return []byte(fmt.Sprintf("%d\n%s", u.UserId, u.Name))
+}
+
+func decodeRegisteredUser(buf []byte) *RegisteredUser {
+	parts := strings.SplitN(string(buf), "\n", 2)
+	if len(parts) != 2 {
+		return &RegisteredUser{}
+	}
+	var id uint32
+	fmt.Sscanf(parts[0], "%d", &id)
+	return &RegisteredUser{UserId: id, Name: parts[1]}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestRegistration opens a Registration backed by a bolt database in a
+// scratch directory that's removed when the test finishes.
+func newTestRegistration(t *testing.T) *Registration {
+	dir := t.TempDir()
+	r, err := NewRegistration(filepath.Join(dir, "registration.db"))
+	if err != nil {
+		t.Fatalf("NewRegistration: %v", err)
+	}
+	return r
+}
+
+// TestRegistrationRenameCollision exercises the collision check Rename
+// needs in order to preserve handleAuthenticate's trust model: a name must
+// map to exactly one NodeID, so renaming one registration onto a name
+// already held by a different NodeID must fail rather than leave two
+// owners for the same name.
+func TestRegistrationRenameCollision(t *testing.T) {
+	r := newTestRegistration(t)
+
+	var alice, bob NodeID
+	alice[0] = 1
+	bob[0] = 2
+
+	if _, err := r.Register(alice, "alice"); err != nil {
+		t.Fatalf("Register(alice): %v", err)
+	}
+	if _, err := r.Register(bob, "bob"); err != nil {
+		t.Fatalf("Register(bob): %v", err)
+	}
+
+	if err := r.Rename(bob, "alice"); err == nil {
+		t.Fatalf("Rename(bob, \"alice\") succeeded, want a collision error")
+	}
+	if owner, user := r.ByName("alice"); owner != alice || user.Name != "alice" {
+		t.Fatalf("ByName(\"alice\") = %v, %v, want alice's registration untouched", owner, user)
+	}
+
+	if err := r.Rename(bob, "robert"); err != nil {
+		t.Fatalf("Rename(bob, \"robert\") to a free name failed: %v", err)
+	}
+	if user := r.Lookup(bob); user.Name != "robert" {
+		t.Fatalf("Lookup(bob).Name = %q, want %q", user.Name, "robert")
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ServerConfig holds the per-virtual-server settings a Meta needs to boot
+// a new Server instance. It mirrors the subset of Server's own fields an
+// operator is expected to configure up front.
+type ServerConfig struct {
+	Address      string
+	Port         int
+	MaxUsers     int
+	MaxBandwidth uint32
+}
+
+// endpointRoute is the cached result of a trial-decrypt over every running
+// virtual server: which server and which of its clients an Endpoint
+// belongs to.
+type endpointRoute struct {
+	serverId int64
+	client   *ClientConnection
+}
+
+// Meta hosts many virtual Murmur instances (Servers) behind a single
+// accept loop and a single UDP bind. Each virtual server keeps its own
+// client list, channel tree and codec state, but dispatch of incoming TLS
+// connections (by SNI) and UDP packets (by trial decryption) is shared.
+type Meta struct {
+	mutex   *sync.RWMutex
+	servers map[int64]*Server
+
+	listener tls.Listener
+	bind     Bind
+
+	epmutex   *sync.RWMutex
+	endpoints map[string]*endpointRoute
+}
+
+// NewMeta creates an empty Meta with no virtual servers registered yet.
+func NewMeta() (m *Meta) {
+	m = new(Meta)
+
+	m.mutex = new(sync.RWMutex)
+	m.servers = make(map[int64]*Server)
+
+	m.epmutex = new(sync.RWMutex)
+	m.endpoints = make(map[string]*endpointRoute)
+
+	return
+}
+
+// NewServer creates and registers a new virtual server under id. It does
+// not start accepting traffic; call StartServer for that.
+func (m *Meta) NewServer(id int64, cfg ServerConfig) (s *Server, err os.Error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.servers[id]; exists {
+		return nil, os.NewError("meta: server id already in use")
+	}
+
+	s, err = NewServer(cfg.Address, cfg.Port)
+	if err != nil {
+		return nil, err
+	}
+	s.id = id
+	s.meta = m
+
+	if cfg.MaxUsers != 0 {
+		s.MaxUsers = cfg.MaxUsers
+	}
+	if cfg.MaxBandwidth != 0 {
+		s.MaxBandwidth = cfg.MaxBandwidth
+	}
+
+	m.servers[id] = s
+
+	return s, nil
+}
+
+// StartServer marks the virtual server as ready to receive dispatched
+// connections and UDP traffic. The shared accept loop and UDP bind must
+// already be running (see Meta.Run).
+func (m *Meta) StartServer(id int64) os.Error {
+	m.mutex.RLock()
+	s, exists := m.servers[id]
+	m.mutex.RUnlock()
+
+	if !exists {
+		return os.NewError("meta: no such server")
+	}
+
+	s.Start()
+	log.Printf("meta: started virtual server %v", id)
+	return nil
+}
+
+// StopServer disconnects every client on the virtual server and removes
+// it from the registry. Callers that want its id available again must
+// register a fresh Server via NewServer.
+func (m *Meta) StopServer(id int64) os.Error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, exists := m.servers[id]
+	if !exists {
+		return os.NewError("meta: no such server")
+	}
+
+	s.Stop()
+	delete(m.servers, id)
+	log.Printf("meta: stopped virtual server %v", id)
+	return nil
+}
+
+// lookupEndpoint returns the endpointRoute previously cached for ep, or
+// nil if ep hasn't been seen (or has roamed away from) any known client.
+func (m *Meta) lookupEndpoint(ep *Endpoint) *endpointRoute {
+	m.epmutex.RLock()
+	defer m.epmutex.RUnlock()
+
+	return m.endpoints[ep.String()]
+}
+
+// bindEndpoint records that ep now routes to client on virtual server
+// serverId, so future packets from it are a single hash lookup rather
+// than a trial-decrypt scan across every running server. Mirrors
+// Server.bindEndpoint for the cache shared across every virtual server.
+func (m *Meta) bindEndpoint(ep *Endpoint, serverId int64, client *ClientConnection) {
+	m.epmutex.Lock()
+	defer m.epmutex.Unlock()
+
+	m.endpoints[ep.String()] = &endpointRoute{serverId: serverId, client: client}
+	client.endpoint = ep
+}
+
+// clearEndpoint removes any cached UDP route pointing at client. Called
+// from Server.clearEndpoint (via Server.removeClient) whenever the
+// client's owning Server is meta-hosted, so a client disconnect or
+// Meta.StopServer doesn't leave a stale entry in m.endpoints forever --
+// the same teardown bindEndpoint's per-Server counterpart already gets
+// for a standalone server.
+func (m *Meta) clearEndpoint(client *ClientConnection) {
+	if client.endpoint == nil {
+		return
+	}
+
+	m.epmutex.Lock()
+	defer m.epmutex.Unlock()
+
+	if route, ok := m.endpoints[client.endpoint.String()]; ok && route.client == client {
+		delete(m.endpoints, client.endpoint.String())
+	}
+}
+
+// Servers returns a snapshot of the currently registered virtual servers.
+func (m *Meta) Servers() []*Server {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	list := make([]*Server, 0, len(m.servers))
+	for _, s := range m.servers {
+		list = append(list, s)
+	}
+	return list
+}
+
+func (m *Meta) serverByName(name string) *Server {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, s := range m.servers {
+		if s.address == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (m *Meta) serverByPort(port int) *Server {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, s := range m.servers {
+		if s.port == port {
+			return s
+		}
+	}
+	return nil
+}
+
+// Run brings up the shared TLS listener and UDP bind and starts
+// dispatching traffic to whichever virtual server owns it.
+func (m *Meta) Run(port int) (err os.Error) {
+	m.bind, err = NewUDPBind(port)
+	if err != nil {
+		return
+	}
+
+	m.listener = NewTLSListener(port)
+	if m.listener == nil {
+		return os.NewError("meta: unable to create shared TLS listener")
+	}
+
+	go m.listenUDP(m.bind.ReceiveIPv4)
+	go m.listenUDP(m.bind.ReceiveIPv6)
+	go m.acceptLoop()
+
+	return nil
+}
+
+// acceptLoop accepts TLS connections on the shared listener and routes
+// each one to the virtual server it belongs to, based on the SNI name
+// the client requested, falling back to the destination port.
+func (m *Meta) acceptLoop() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			log.Printf("meta: unable to accept()")
+			continue
+		}
+
+		go m.dispatch(conn)
+	}
+}
+
+func (m *Meta) dispatch(conn net.Conn) {
+	tlsconn, ok := conn.(*tls.Conn)
+	if !ok {
+		log.Printf("meta: not tls :(")
+		conn.Close()
+		return
+	}
+
+	// Force the handshake so the SNI server name (and, eventually, the
+	// peer certificate) is available before we pick a virtual server.
+	tlsconn.Handshake()
+
+	state := tlsconn.ConnectionState()
+
+	var server *Server
+	if state.ServerName != "" {
+		server = m.serverByName(state.ServerName)
+	}
+	if server == nil {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			server = m.serverByPort(addr.Port)
+		}
+	}
+
+	if server == nil {
+		log.Printf("meta: no virtual server for connection from %v", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	if !server.Started() {
+		log.Printf("meta: virtual server %v not started, rejecting connection from %v", server.id, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	err := server.NewClient(conn)
+	if err != nil {
+		log.Printf("meta: unable to start new client on server %v", server.id)
+	}
+}
+
+// listenUDP mirrors Server.listenUDP, but since the bind (and therefore
+// the UDP port) is shared across every virtual server, a cache miss has
+// to trial-decrypt against every running server's client list instead of
+// just one.
+func (m *Meta) listenUDP(receive func([]byte) (int, *Endpoint, os.Error)) {
+	buf := make([]byte, UDPPacketSize)
+	for {
+		nread, ep, err := receive(buf)
+		if err != nil {
+			continue
+		}
+
+		// Length 12 is for ping datagrams from the ConnectDialog (see
+		// Server.listenUDP). The shared bind can't tell which virtual
+		// server a ping was meant for, so it's answered with user counts
+		// and MaxUsers summed across every started server, and the
+		// smallest MaxBandwidth among them, instead of going unanswered.
+		if nread == 12 {
+			readbuf := bytes.NewBuffer(buf)
+			var (
+				tmp32 uint32
+				rand  uint64
+			)
+			_ = binary.Read(readbuf, binary.BigEndian, &tmp32)
+			_ = binary.Read(readbuf, binary.BigEndian, &rand)
+
+			var numUsers, maxUsers uint32
+			var maxBandwidth uint32
+			for _, s := range m.Servers() {
+				if !s.Started() {
+					continue
+				}
+				s.cmutex.RLock()
+				numUsers += uint32(len(s.clients))
+				s.cmutex.RUnlock()
+				maxUsers += uint32(s.MaxUsers)
+				if maxBandwidth == 0 || s.MaxBandwidth < maxBandwidth {
+					maxBandwidth = s.MaxBandwidth
+				}
+			}
+
+			m.bind.Send(pingReply(rand, numUsers, maxUsers, maxBandwidth), ep)
+			continue
+		}
+
+		plain := make([]byte, nread-4)
+
+		route := m.lookupEndpoint(ep)
+		if route != nil {
+			route.client.cryptMutex.RLock()
+			err = route.client.crypt.Decrypt(buf[0:nread], plain[0:])
+			route.client.cryptMutex.RUnlock()
+			if err == nil {
+				atomic.AddUint32(&route.client.cryptGood, 1)
+				route.client.udp = true
+				route.client.server.recordUDPPing(route.client)
+				route.client.udprecv <- plain
+				continue
+			}
+			atomic.AddUint32(&route.client.cryptLost, 1)
+			// Stale route (client reconnected under a fresh cryptstate).
+			// Fall through to the trial-decrypt loop below.
+		}
+
+		var match *ClientConnection
+		var matchId int64
+		for _, s := range m.Servers() {
+			s.cmutex.RLock()
+			for _, client := range s.clients {
+				client.cryptMutex.RLock()
+				err = client.crypt.Decrypt(buf[0:nread], plain[0:])
+				client.cryptMutex.RUnlock()
+				if err == nil {
+					match = client
+					matchId = s.id
+					break
+				}
+			}
+			s.cmutex.RUnlock()
+			if match != nil {
+				break
+			}
+		}
+
+		if match == nil {
+			continue
+		}
+
+		m.bindEndpoint(ep, matchId, match)
+
+		atomic.AddUint32(&match.cryptGood, 1)
+		match.udp = true
+		match.server.recordUDPPing(match)
+		match.udprecv <- plain
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestMetaServerByPort exercises dispatch's port-based fallback: with no
+// SNI match, a connection should be routed to the virtual server bound to
+// its destination port.
+func TestMetaServerByPort(t *testing.T) {
+	m := NewMeta()
+
+	a, err := m.NewServer(1, ServerConfig{Address: "a.example.com", Port: 64738})
+	if err != nil {
+		t.Fatalf("NewServer(1): %v", err)
+	}
+	if _, err := m.NewServer(2, ServerConfig{Address: "b.example.com", Port: 64739}); err != nil {
+		t.Fatalf("NewServer(2): %v", err)
+	}
+
+	if got := m.serverByPort(64738); got != a {
+		t.Fatalf("serverByPort(64738) = %v, want server 1", got)
+	}
+	if got := m.serverByPort(64739); got == a {
+		t.Fatalf("serverByPort(64739) resolved to server 1, want server 2")
+	}
+	if got := m.serverByPort(1); got != nil {
+		t.Fatalf("serverByPort(1) = %v, want nil for an unbound port", got)
+	}
+}
+
+// TestMetaEndpointLifecycle exercises the Meta-wide endpoint cache's
+// teardown path: Server.removeClient (as called by Stop/StopServer) has
+// to clear a meta-hosted client's route out of m.endpoints, not the dead
+// per-Server endpoints map, or it leaks forever.
+func TestMetaEndpointLifecycle(t *testing.T) {
+	m := NewMeta()
+
+	s, err := m.NewServer(1, ServerConfig{Address: "a.example.com", Port: 0})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	client := newTestClient(t)
+	s.cmutex.Lock()
+	s.clients = append(s.clients, client)
+	s.cmutex.Unlock()
+
+	ep := NewEndpoint(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 60001})
+	m.bindEndpoint(ep, s.id, client)
+
+	if route := m.lookupEndpoint(ep); route == nil || route.client != client {
+		t.Fatalf("lookupEndpoint() = %v, want a route to client", route)
+	}
+
+	s.removeClient(client)
+
+	if route := m.lookupEndpoint(ep); route != nil {
+		t.Fatalf("lookupEndpoint() = %v after removeClient, want the stale route cleared", route)
+	}
+}
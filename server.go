@@ -14,6 +14,8 @@ import (
 	"encoding/binary"
 	"container/list"
 	"sync"
+	"sync/atomic"
+	"time"
 	"goprotobuf.googlecode.com/hg/proto"
 	"mumbleproto"
 	"cryptstate"
@@ -36,19 +38,39 @@ const (
 
 // A Murmur server instance
 type Server struct {
+	// id and meta are only set when this Server is hosted as a virtual
+	// server under a Meta; a standalone Server started via
+	// ListenAndMurmur leaves both zero.
+	id   int64
+	meta *Meta
+
 	listener tls.Listener
 	address  string
 	port     int
-	udpconn  *net.UDPConn
+	bind     Bind
 
 	incoming chan *Message
 	outgoing chan *Message
 
 	udpsend chan *Message
 
+	// Admin RPC requests land here (see control.go) so they're handled on
+	// the same goroutine as client traffic, instead of racing it.
+	control chan *ControlMessage
+
+	// Cache of known UDP endpoints, keyed on Endpoint.String(), so packet
+	// dispatch in ListenUDP is a single hash lookup instead of a linear
+	// scan of clients. Kept under its own lock since it's on the hot path
+	// and shouldn't contend with cmutex, which guards client lifecycle.
+	epmutex   *sync.RWMutex
+	endpoints map[string]*ClientConnection
+
 	// Config-related
 	MaxUsers int
 	MaxBandwidth uint32
+	// RekeyInterval is how often a connected client's CryptState is
+	// rotated; zero means DefaultRekeyInterval.
+	RekeyInterval int64
 
 	session uint32
 
@@ -62,6 +84,32 @@ type Server struct {
 	PreferAlphaCodec bool
 
 	root *Channel
+
+	// Identity/registration
+	RequireCertificate bool
+	registration *Registration
+
+	// Bans imposed via the control-plane BanUser request. Checked by
+	// address (not NodeID, since a kicked/banned session may not even
+	// have a certificate) against every new TCP connection.
+	bmutex *sync.Mutex
+	bans   []Ban
+
+	// Lifecycle. A standalone Server started via ListenAndMurmur calls
+	// Start itself and runs for the life of the process; a Server hosted
+	// under a Meta sits idle (registered but not dispatched to) until an
+	// operator calls Meta.StartServer, and can be torn down again with
+	// Meta.StopServer without restarting the whole process. See Start/Stop.
+	lifecycleMutex *sync.Mutex
+	started        bool
+	stop           chan bool
+}
+
+// Ban is a temporary block on a client address reconnecting, imposed by
+// the control-plane BanUser request.
+type Ban struct {
+	Address net.IP
+	Until   int64 // absolute deadline, in time.Nanoseconds()
 }
 
 // A Mumble channel
@@ -84,9 +132,13 @@ func NewServer(addr string, port int) (s *Server, err os.Error) {
 	// Create the list of connected clients
 	s.cmutex = new(sync.RWMutex)
 
+	s.epmutex = new(sync.RWMutex)
+	s.endpoints = make(map[string]*ClientConnection)
+
 	s.outgoing = make(chan *Message)
 	s.incoming = make(chan *Message)
 	s.udpsend = make(chan *Message)
+	s.control = make(chan *ControlMessage)
 
 	s.MaxBandwidth = 300000
 	s.MaxUsers = 10
@@ -98,14 +150,80 @@ func NewServer(addr string, port int) (s *Server, err os.Error) {
 		Name: "Root",
 	}
 
+	s.lifecycleMutex = new(sync.Mutex)
+	s.bmutex = new(sync.Mutex)
+
+	return
+}
+
+// Start launches the server's background goroutines (client/control
+// dispatch, UDP timeout sweeps, CryptState rekeying). It's idempotent.
+// ListenAndMurmur calls this itself for standalone use; Meta.StartServer
+// calls it for virtual-hosted servers once an operator asks for them to
+// go live.
+func (s *Server) Start() {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+
+	if s.started {
+		return
+	}
+	s.started = true
+	s.stop = make(chan bool)
+
 	go s.handler()
 	go s.multiplexer()
+	go s.watchUDPTimeouts()
+	go s.rekeyLoop(s.RekeyInterval)
+}
 
-	return
+// Started reports whether Start has been called. Meta uses this to keep
+// a registered-but-not-yet-started virtual server from being dispatched
+// to.
+func (s *Server) Started() bool {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	return s.started
+}
+
+// Stop disconnects every connected client and signals the server's
+// background goroutines (handler, multiplexer, the UDP timeout sweep and
+// the rekey loop) to exit, so a create/start/stop cycle under Meta
+// doesn't leak them. It's a no-op if the server isn't currently started.
+func (s *Server) Stop() {
+	s.lifecycleMutex.Lock()
+	if !s.started {
+		s.lifecycleMutex.Unlock()
+		return
+	}
+	s.started = false
+	stop := s.stop
+	s.lifecycleMutex.Unlock()
+
+	close(stop)
+
+	s.cmutex.RLock()
+	clients := make([]*ClientConnection, len(s.clients))
+	copy(clients, s.clients)
+	s.cmutex.RUnlock()
+
+	for _, client := range clients {
+		client.Panic("Server stopped")
+		s.removeClient(client)
+	}
 }
 
 // Called by the server to initiate a new client connection.
 func (server *Server) NewClient(conn net.Conn) (err os.Error) {
+	// Meta.dispatch already checks Started() before calling us, but a
+	// standalone ListenAndMurmur's accept loop doesn't -- so a
+	// ControlShutdown (or any other caller of Stop) needs this check
+	// here too, or a client could reconnect the instant Stop returns.
+	if !server.Started() {
+		conn.Close()
+		return os.NewError("server is stopped")
+	}
+
 	client := new(ClientConnection)
 
 	// Get the address of the connected client
@@ -114,8 +232,29 @@ func (server *Server) NewClient(conn net.Conn) (err os.Error) {
 		log.Printf("client connected: %s", client.tcpaddr.String())
 	}
 
+	if client.tcpaddr != nil && server.banned(client.tcpaddr.IP) {
+		log.Printf("rejecting banned client %s", client.tcpaddr.String())
+		conn.Close()
+		return os.NewError("client is banned")
+	}
+
 	client.server = server
 	client.conn = conn
+	client.cryptMutex = new(sync.RWMutex)
+
+	// If this is a TLS connection that has already completed its
+	// handshake (ListenAndMurmur forces this before calling NewClient),
+	// derive the client's durable NodeID from its certificate now, so
+	// handleAuthenticate has it available regardless of what username
+	// the client claims.
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		certs := tlsconn.ConnectionState().PeerCertificates
+		if len(certs) > 0 {
+			client.Identity = NewNodeID(certs[0])
+			client.hasCertificate = true
+		}
+	}
+
 	client.reader = bufio.NewReader(client.conn)
 	client.writer = bufio.NewWriter(client.conn)
 	client.state = StateClientConnected
@@ -139,6 +278,43 @@ func (server *Server) NewClient(conn net.Conn) (err os.Error) {
 	return
 }
 
+// ban blocks addr from reconnecting for duration seconds, imposed by the
+// control-plane BanUser request. It does not affect the client's current
+// connection; callers that want to disconnect them too should follow up
+// with Panic/removeClient, same as ControlKickUser does.
+func (server *Server) ban(addr net.IP, duration int64) {
+	server.bmutex.Lock()
+	defer server.bmutex.Unlock()
+
+	server.bans = append(server.bans, Ban{
+		Address: addr,
+		Until:   time.Nanoseconds() + duration*1e9,
+	})
+}
+
+// banned reports whether addr is currently serving out a ban, pruning any
+// bans that have since expired.
+func (server *Server) banned(addr net.IP) bool {
+	server.bmutex.Lock()
+	defer server.bmutex.Unlock()
+
+	now := time.Nanoseconds()
+	live := server.bans[:0]
+	blocked := false
+	for _, b := range server.bans {
+		if b.Until <= now {
+			continue
+		}
+		live = append(live, b)
+		if b.Address.Equal(addr) {
+			blocked = true
+		}
+	}
+	server.bans = live
+
+	return blocked
+}
+
 // Lookup a client by it's session id. Optimize this by using a map.
 func (server *Server) getClientConnection(session uint32) (client *ClientConnection) {
 	server.cmutex.RLock()
@@ -156,13 +332,19 @@ func (server *Server) getClientConnection(session uint32) (client *ClientConnect
 // This is the synchronous request handler for all incoming messages.
 func (server *Server) handler() {
 	for {
-		msg := <-server.incoming
-		client := msg.client
-
-		if client.state == StateClientAuthenticated {
-			server.handleIncomingMessage(client, msg)
-		} else if client.state == StateClientSentVersion {
-			server.handleAuthenticate(client, msg)
+		select {
+		case msg := <-server.incoming:
+			client := msg.client
+
+			if client.state == StateClientAuthenticated {
+				server.handleIncomingMessage(client, msg)
+			} else if client.state == StateClientSentVersion {
+				server.handleAuthenticate(client, msg)
+			}
+		case ctrl := <-server.control:
+			server.handleControlMessage(ctrl)
+		case <-server.stop:
+			return
 		}
 	}
 }
@@ -187,14 +369,50 @@ func (server *Server) handleAuthenticate(client *ClientConnection, msg *Message)
 		return
 	}
 
-	client.Username = *auth.Username
+	if server.RequireCertificate && !client.hasCertificate {
+		client.Panic("This server requires a client certificate.")
+		return
+	}
+
+	requested := *auth.Username
+
+	if server.registration != nil {
+		if client.hasCertificate {
+			if registered := server.registration.Lookup(client.Identity); registered != nil {
+				// This NodeID already owns a name; it always wins over
+				// whatever the client asked for.
+				requested = registered.Name
+			} else if _, owner := server.registration.ByName(requested); owner != nil {
+				// Someone else's NodeID already registered this name.
+				client.Panic("That username is registered to another certificate.")
+				return
+			} else {
+				_, err := server.registration.Register(client.Identity, requested)
+				if err != nil {
+					client.Panic(err.String())
+					return
+				}
+			}
+		} else if _, owner := server.registration.ByName(requested); owner != nil {
+			// No certificate at all, so this client can't possibly be the
+			// NodeID that owns this name. Reject regardless, so a
+			// cert-less connection can't impersonate a registered user.
+			client.Panic("That username is registered to a certificate.")
+			return
+		}
+	}
 
-	// Setup the cryptstate for the client.
+	client.Username = requested
+
+	// Setup the cryptstate for the client. lastRekey is seeded here so
+	// Server.rekeyLoop measures RekeyInterval from connect time rather
+	// than rekeying the client on its very first check.
 	client.crypt, err = cryptstate.New()
 	if err != nil {
 		client.Panic(err.String())
 		return
 	}
+	atomic.StoreInt64(&client.lastRekey, time.Nanoseconds())
 	err = client.crypt.GenerateKey()
 	if err != nil {
 		client.Panic(err.String())
@@ -220,11 +438,15 @@ func (server *Server) handleAuthenticate(client *ClientConnection, msg *Message)
 	client.state = StateClientAuthenticated
 
 	// Broadcast that we, the client, entered a channel...
-	err = server.broadcastProtoMessage(MessageUserState, &mumbleproto.UserState{
+	userState := &mumbleproto.UserState{
 		Session:    proto.Uint32(client.Session),
 		Name:       proto.String(client.Username),
 		ChannelId:  proto.Uint32(0),
-	})
+	}
+	if client.hasCertificate {
+		userState.Hash = proto.String(client.Identity.String())
+	}
+	err = server.broadcastProtoMessage(MessageUserState, userState)
 	if err != nil {
 		client.Panic(err.String())
 	}
@@ -322,11 +544,15 @@ func (server *Server) sendUserList(client *ClientConnection) {
 			continue
 		}
 
-		err := client.sendProtoMessage(MessageUserState, &mumbleproto.UserState{
+		userState := &mumbleproto.UserState{
 			Session:   proto.Uint32(user.Session),
 			Name:      proto.String(user.Username),
 			ChannelId: proto.Uint32(0),
-		})
+		}
+		if user.hasCertificate {
+			userState.Hash = proto.String(user.Identity.String())
+		}
+		err := client.sendProtoMessage(MessageUserState, userState)
 
 		log.Printf("Sent one user")
 
@@ -378,6 +604,8 @@ func (server *Server) handleIncomingMessage(client *ClientConnection, msg *Messa
 		server.handleQueryUsers(msg.client, msg)
 	case MessageCryptSetup:
 		server.handleCryptSetup(msg.client, msg)
+	case MessageUDPTunnel:
+		server.handleUDPTunnel(msg.client, msg)
 	case MessageContextActionAdd:
 		log.Printf("MessageContextActionAdd from client")
 	case MessageContextAction:
@@ -401,16 +629,17 @@ func (server *Server) handleIncomingMessage(client *ClientConnection, msg *Messa
 
 func (server *Server) multiplexer() {
 	for {
-		_ = <-server.outgoing
-		log.Printf("recvd message to multiplex")
+		select {
+		case <-server.outgoing:
+			log.Printf("recvd message to multiplex")
+		case <-server.stop:
+			return
+		}
 	}
 }
 
 func (s *Server) SetupUDP() (err os.Error) {
-	addr := &net.UDPAddr{
-		Port: s.port,
-	}
-	s.udpconn, err = net.ListenUDP("udp", addr)
+	s.bind, err = NewUDPBind(s.port)
 	if err != nil {
 		return
 	}
@@ -424,35 +653,157 @@ func (s *Server) SendUDP() {
 		if msg.client != nil {
 			// These are to be crypted...
 			crypted := make([]byte, len(msg.buf)+4)
+			msg.client.cryptMutex.RLock()
 			msg.client.crypt.Encrypt(msg.buf, crypted)
-			//s.udpconn.WriteTo(crypted, msg.client.udpaddr)
+			msg.client.cryptMutex.RUnlock()
+			//s.bind.Send(crypted, msg.client.endpoint)
 			b := make([]byte, 1)
-			s.udpconn.WriteTo(b, msg.client.udpaddr)
-		} else if msg.address != nil {
-			s.udpconn.WriteTo(msg.buf, msg.address)
+			s.bind.Send(b, msg.client.endpoint)
+		} else if msg.endpoint != nil {
+			s.bind.Send(msg.buf, msg.endpoint)
 		} else {
 			// Skipping
 		}
 	}
 }
 
-// Listen for and handle UDP packets.
-func (server *Server) ListenUDP() {
+// lookupEndpoint returns the ClientConnection previously cached for ep, or
+// nil if ep hasn't been seen (or has roamed away from) any known client.
+func (server *Server) lookupEndpoint(ep *Endpoint) (client *ClientConnection) {
+	server.epmutex.RLock()
+	defer server.epmutex.RUnlock()
+
+	return server.endpoints[ep.String()]
+}
+
+// bindEndpoint records that ep now routes to client, so future packets
+// from it are a single hash lookup rather than a trial-decrypt scan.
+func (server *Server) bindEndpoint(ep *Endpoint, client *ClientConnection) {
+	server.epmutex.Lock()
+	defer server.epmutex.Unlock()
+
+	server.endpoints[ep.String()] = client
+	client.endpoint = ep
+}
+
+// clearEndpoint removes any cached UDP route pointing at client, so a
+// source port the client vacates can't keep resolving to it (and, once
+// recycled by the OS to some other host, can't be handed a dead
+// connection's decrypted voice stream). When server is hosted under a
+// Meta, the real route lives in the shared Meta-wide cache instead of
+// server.endpoints (dead weight in that case), so the clear has to go
+// there too.
+func (server *Server) clearEndpoint(client *ClientConnection) {
+	if client.endpoint == nil {
+		return
+	}
+
+	if server.meta != nil {
+		server.meta.clearEndpoint(client)
+		return
+	}
+
+	server.epmutex.Lock()
+	defer server.epmutex.Unlock()
+
+	if server.endpoints[client.endpoint.String()] == client {
+		delete(server.endpoints, client.endpoint.String())
+	}
+}
+
+// removeClient drops client from the connected-client list and clears
+// its cached UDP route. Call this once a client's connection is known
+// to be over.
+func (server *Server) removeClient(client *ClientConnection) {
+	server.cmutex.Lock()
+	for i, c := range server.clients {
+		if c == client {
+			server.clients = append(server.clients[:i], server.clients[i+1:]...)
+			break
+		}
+	}
+	server.cmutex.Unlock()
+
+	server.clearEndpoint(client)
+}
+
+// pingReply builds the 24-byte UDP ping response the ConnectDialog's
+// server browser expects: protocol version, the nonce the client sent,
+// and current/max user and bandwidth counts.
+func pingReply(rand uint64, numUsers, maxUsers uint32, maxBandwidth uint32) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, 24))
+	_ = binary.Write(buffer, binary.BigEndian, uint32((1<<16)|(2<<8)|2))
+	_ = binary.Write(buffer, binary.BigEndian, rand)
+	_ = binary.Write(buffer, binary.BigEndian, numUsers)
+	_ = binary.Write(buffer, binary.BigEndian, maxUsers)
+	_ = binary.Write(buffer, binary.BigEndian, maxBandwidth)
+	return buffer.Bytes()
+}
+
+// decryptVoicePacket resolves buf, a full on-wire voice packet, to the
+// client it belongs to, preferring the cached endpoint route (see
+// bindEndpoint) and falling back to a trial-decrypt scan of every
+// connected client when the cache is empty or stale. A fallback hit
+// refreshes the cache, so ep doesn't keep taking the slow path, and so a
+// stale cache entry (e.g. the client behind ep roamed, reconnecting
+// under a fresh CryptState while keeping the same NAT-mapped source
+// port) doesn't keep failing forever.
+func (server *Server) decryptVoicePacket(buf []byte, ep *Endpoint) (match *ClientConnection, plain []byte) {
+	plain = make([]byte, len(buf)-4)
+
+	if cached := server.lookupEndpoint(ep); cached != nil {
+		cached.cryptMutex.RLock()
+		err := cached.crypt.Decrypt(buf, plain)
+		cached.cryptMutex.RUnlock()
+
+		if err == nil {
+			atomic.AddUint32(&cached.cryptGood, 1)
+			return cached, plain
+		}
+		atomic.AddUint32(&cached.cryptLost, 1)
+	}
+
+	// Slow path: endpoint is unknown (new client, one that has roamed to
+	// a new address, or a cache entry that just went stale above). Fall
+	// back to the trial-decrypt loop, and cache the result on success so
+	// we don't have to do this again for this endpoint.
+	server.cmutex.RLock()
+	for _, client := range server.clients {
+		client.cryptMutex.RLock()
+		err := client.crypt.Decrypt(buf, plain)
+		client.cryptMutex.RUnlock()
+		if err != nil {
+			continue
+		}
+
+		log.Printf("Client UDP connection established.")
+		match = client
+		break
+	}
+	server.cmutex.RUnlock()
+
+	if match == nil {
+		return nil, nil
+	}
+
+	server.bindEndpoint(ep, match)
+	atomic.AddUint32(&match.cryptGood, 1)
+	return match, plain
+}
+
+// Listen for and handle UDP packets arriving on bind.
+func (server *Server) listenUDP(receive func([]byte) (int, *Endpoint, os.Error)) {
 	buf := make([]byte, UDPPacketSize)
 	for {
-		nread, remote, err := server.udpconn.ReadFrom(buf)
+		nread, ep, err := receive(buf)
 		if err != nil {
 			// Not much to do here. This is bad, of course. Should we panic this server instance?
 			continue
 		}
 
-		udpaddr, ok := remote.(*net.UDPAddr)
-		if !ok {
-			log.Printf("No UDPAddr in read packet. Disabling UDP. (Windows?)")
-			return
-		}
-
-		// Length 12 is for ping datagrams from the ConnectDialog.
+		// Length 12 is for ping datagrams from the ConnectDialog. These
+		// share the bind with voice traffic so the ping-reply path never
+		// has to compete with the client list lock used by voice.
 		if nread == 12 {
 			readbuf := bytes.NewBuffer(buf)
 			var (
@@ -462,78 +813,39 @@ func (server *Server) ListenUDP() {
 			_ = binary.Read(readbuf, binary.BigEndian, &tmp32)
 			_ = binary.Read(readbuf, binary.BigEndian, &rand)
 
-			buffer := bytes.NewBuffer(make([]byte, 0, 24))
-			_ = binary.Write(buffer, binary.BigEndian, uint32((1<<16)|(2<<8)|2))
-			_ = binary.Write(buffer, binary.BigEndian, rand)
-			_ = binary.Write(buffer, binary.BigEndian, uint32(len(server.clients)))
-			_ = binary.Write(buffer, binary.BigEndian, uint32(server.MaxUsers))
-			_ = binary.Write(buffer, binary.BigEndian, uint32(server.MaxBandwidth))
-
 			server.udpsend <- &Message{
-				buf: buffer.Bytes(),
-				address: udpaddr,
-			}
-		} else {
-			var match *ClientConnection
-			plain := make([]byte, nread-4)
-			decrypted := false
-
-			// First, check if any of our clients match the net.UDPAddr...
-			server.cmutex.RLock()
-			for _, client := range server.clients {
-				if client.udpaddr.String() == udpaddr.String() {
-					match = client
-				}
-			}
-			server.cmutex.RUnlock()
-
-			// No matching client found. We must try to decrypt...
-			if match == nil {
-				server.cmutex.RLock()
-				for _, client := range server.clients {
-					// Try to decrypt.
-					err = client.crypt.Decrypt(buf[0:nread], plain[0:])
-					if err != nil {
-						// Decryption failed. Try another client...
-						continue
-					}
-
-					// Decryption succeeded.
-					decrypted = true
-
-					// If we were able to successfully decrpyt, add
-					// the UDPAddr to the ClientConnection struct.
-					log.Printf("Client UDP connection established.")
-					client.udpaddr = remote.(*net.UDPAddr)
-					match = client
-
-					break
-				}
-				server.cmutex.RUnlock()
-			}
-
-			// We were not able to find a client that could decrypt the incoming
-			// packet. Log it?
-			if match == nil {
-				continue
-			}
-
-			if !decrypted {
-				err = match.crypt.Decrypt(buf[0:nread], plain[0:])
-				if err != nil {
-					log.Printf("Unable to decrypt from client..")
-				}
+				buf:      pingReply(rand, uint32(len(server.clients)), uint32(server.MaxUsers), server.MaxBandwidth),
+				endpoint: ep,
 			}
+			continue
+		}
 
-			match.udp = true
-			match.udprecv <- plain
+		match, plain := server.decryptVoicePacket(buf[0:nread], ep)
+		if match == nil {
+			// We were not able to find a client that could decrypt the
+			// incoming packet. Log it?
+			continue
 		}
+
+		match.udp = true
+		server.recordUDPPing(match)
+		match.udprecv <- plain
 	}
 }
 
+// ListenUDP dispatches inbound IPv4 and IPv6 voice (and ping) traffic to
+// the shared handler in separate goroutines, one per address family.
+func (server *Server) ListenUDP() {
+	go server.listenUDP(server.bind.ReceiveIPv4)
+	server.listenUDP(server.bind.ReceiveIPv6)
+}
+
 // The accept loop of the server.
 func (s *Server) ListenAndMurmur() {
 
+	// Standalone use: there's no Meta around to call Start for us.
+	s.Start()
+
 	// Setup our UDP listener and spawn our reader and writer goroutines
 	s.SetupUDP()
 	go s.ListenUDP()
@@ -0,0 +1,97 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"time"
+)
+
+// UDPPingTimeout is how long we'll go without a UDP ping from a client
+// before assuming it has lost its UDP path (NAT rebind, network change,
+// etc.) and falling back to tunneling voice over the TCP connection.
+const UDPPingTimeout = 20e9 // 20 seconds, in nanoseconds
+
+// handleUDPTunnel handles a MessageUDPTunnel: its payload is the exact
+// same voice packet format ListenUDP decodes (voice header byte, target,
+// session varint, sequence varint, codec frames), just carried over TLS
+// instead of UDP, for clients that can't get a UDP packet through their
+// NAT. We feed it into the same channel the UDP path uses so downstream
+// handling doesn't care which transport the packet arrived on.
+func (server *Server) handleUDPTunnel(client *ClientConnection, msg *Message) {
+	client.udprecv <- msg.buf
+}
+
+// handleUserStateMessage applies the UseTunnel preference from an
+// incoming UserState update: a client may explicitly opt into tunneling
+// voice over its TCP connection (e.g. to avoid revealing its UDP source
+// address), rather than waiting out UDPPingTimeout for sendVoice to fall
+// back to it on its own.
+func (server *Server) handleUserStateMessage(client *ClientConnection, msg *Message) {
+	req := &mumbleproto.UserState{}
+	err := proto.Unmarshal(msg.buf, req)
+	if err != nil {
+		client.Panic("Unable to unmarshal UserState message.")
+		return
+	}
+
+	if req.UseTunnel != nil {
+		client.useTunnel = req.GetUseTunnel()
+	}
+}
+
+// sendVoice delivers an outbound voice packet to client, tunneling it
+// over TCP as a MessageUDPTunnel if we don't currently believe UDP is
+// reachable for them, or if they've explicitly asked to tunnel via
+// UseTunnel.
+func (server *Server) sendVoice(client *ClientConnection, buf []byte) {
+	if !client.udp || client.useTunnel {
+		client.msgchan <- &Message{
+			kind:   MessageUDPTunnel,
+			buf:    buf,
+			client: client,
+		}
+		return
+	}
+
+	server.udpsend <- &Message{
+		buf:    buf,
+		client: client,
+	}
+}
+
+// watchUDPTimeouts periodically clears the udp flag on clients we haven't
+// heard a UDP ping from recently, so voice transparently falls back to
+// the TCP tunnel if a client's UDP path dies mid-session (common on
+// mobile, switching between WiFi and cellular).
+func (server *Server) watchUDPTimeouts() {
+	for {
+		select {
+		case <-time.After(UDPPingTimeout / 2):
+		case <-server.stop:
+			return
+		}
+
+		server.cmutex.RLock()
+		for _, client := range server.clients {
+			if client.udp && time.Nanoseconds()-client.lastUDPPing > UDPPingTimeout {
+				client.udp = false
+				if client.endpoint != nil {
+					client.endpoint.ClearSrc()
+				}
+			}
+		}
+		server.cmutex.RUnlock()
+	}
+}
+
+// recordUDPPing notes that a UDP voice packet from client was just
+// decrypted, so watchUDPTimeouts keeps its udp flag set. Only the UDP
+// receive paths call it; traffic over the TCP connection does not keep
+// udp true.
+func (server *Server) recordUDPPing(client *ClientConnection) {
+	client.lastUDPPing = time.Nanoseconds()
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"testing"
+)
+
+// benchSendVoice sets up a Server/ClientConnection pair wired up enough
+// for sendVoice to run its dispatch logic, with a drain goroutine on
+// whichever channel that path feeds (the client's msgchan for the TCP
+// tunnel, the server's udpsend for UDP) so sending never blocks.
+func benchSendVoice(udp bool) (*Server, *ClientConnection) {
+	server, _ := NewServer("127.0.0.1", 0)
+
+	client := new(ClientConnection)
+	client.msgchan = make(chan *Message)
+	client.udp = udp
+
+	go func() {
+		for _ = range client.msgchan {
+		}
+	}()
+	go func() {
+		for _ = range server.udpsend {
+		}
+	}()
+
+	return server, client
+}
+
+// TestSendVoiceUseTunnel exercises the UseTunnel signal: a client with a
+// working UDP path should still have its voice routed over the TCP
+// tunnel once it's sent a UserState opting into tunneling.
+func TestSendVoiceUseTunnel(t *testing.T) {
+	server, _ := NewServer("127.0.0.1", 0)
+
+	client := new(ClientConnection)
+	client.msgchan = make(chan *Message, 1)
+	client.udp = true
+
+	buf, err := proto.Marshal(&mumbleproto.UserState{UseTunnel: proto.Bool(true)})
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	server.handleUserStateMessage(client, &Message{client: client, buf: buf})
+
+	if !client.useTunnel {
+		t.Fatalf("useTunnel = false after a UserState with UseTunnel=true")
+	}
+
+	voice := []byte("frame")
+	server.sendVoice(client, voice)
+
+	select {
+	case msg := <-client.msgchan:
+		if msg.kind != MessageUDPTunnel {
+			t.Fatalf("sendVoice sent kind %v, want MessageUDPTunnel", msg.kind)
+		}
+	default:
+		t.Fatalf("sendVoice did not tunnel a voice packet for a client with UseTunnel set")
+	}
+}
+
+// BenchmarkSendVoiceTunnel measures sendVoice's cost when a client has no
+// usable UDP path and every voice packet has to be wrapped as a
+// MessageUDPTunnel and carried over the TCP connection instead.
+func BenchmarkSendVoiceTunnel(b *testing.B) {
+	server, client := benchSendVoice(false)
+	buf := make([]byte, 128)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.sendVoice(client, buf)
+	}
+}
+
+// BenchmarkSendVoiceUDP measures sendVoice's cost on the UDP fast path,
+// for comparison against BenchmarkSendVoiceTunnel.
+func BenchmarkSendVoiceUDP(b *testing.B) {
+	server, client := benchSendVoice(true)
+	buf := make([]byte, 128)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.sendVoice(client, buf)
+	}
+}